@@ -8,66 +8,186 @@ import (
 	"bytes"
 	"errors"
 	"io"
+	"sync"
+	"time"
 )
 
 var (
 	errBiggerThanMaxLen = errors.New("chunky: chunk was bigger MaxWriteLength")
 	errUnexpectedLen    = errors.New("chunky: write returned unexpected length")
 	errFlushBeforeMark  = errors.New("chunky: Flush called before Mark")
+
+	// ErrTransformedTooBig is returned by Mark or Flush when Transform is set
+	// and the chunk it produces is bigger than MaxWriteLength. Unlike a chunk
+	// that was too big going in, this can't be caught until the chunk is
+	// about to be written, so callers that hit it need to mark more often to
+	// give Transform smaller input.
+	ErrTransformedTooBig = errors.New("chunky: transformed chunk was bigger than MaxWriteLength")
 )
 
+// defaultTransformInputMultiple is the multiple of MaxWriteLength applied to
+// the raw input bound when Transform is set and TransformInputMultiple is
+// left at its zero value.
+const defaultTransformInputMultiple = 4
+
+// chunkJob is a completed chunk handed to the worker pool, tagged with its
+// position in the stream so workers write it to Writer in that same order.
+type chunkJob struct {
+	seq  uint64
+	data []byte
+}
+
 // Writer provides the chunky writer functionality that allows for aggregating
 // chunks as best possible while preventing splitting of chunks. This Writer is
 // NOT safe for concurrent use.
 type Writer struct {
 	Writer         io.Writer
 	MaxWriteLength int
-	mark           int
-	two            bool
-	buf1           bytes.Buffer
-	buf2           bytes.Buffer
+
+	// PipelineDepth, if greater than 1, hands completed chunks to a pool of
+	// this many goroutines instead of writing them inline, so Mark and
+	// Flush can return before the chunk they just finished has actually
+	// reached Writer. It does not make the underlying writes run in
+	// parallel: every worker still waits for the chunk before it to finish
+	// first, since Writer is usually a single ordered sink (a stream, or a
+	// net.Conn) that would corrupt if chunks landed out of order. Flush
+	// blocks until the pool has drained and returns the first write error
+	// encountered, if any. Mark and Flush also surface that first error
+	// immediately once it has occurred. A Writer with PipelineDepth > 1
+	// must be Close'd once it is done being used, or its worker pool leaks
+	// for the life of the process.
+	PipelineDepth int
+
+	// Transform, if set, is run on each chunk between the last Mark boundary
+	// and the underlying Write, so callers can attach compression, a
+	// checksum or encryption. MaxWriteLength is then enforced on the
+	// transformed chunk rather than the raw input; see ErrTransformedTooBig.
+	Transform func(in []byte) ([]byte, error)
+
+	// TransformInputMultiple bounds how large the raw input accumulated
+	// since the last Mark may grow when Transform is set, as a multiple of
+	// MaxWriteLength: Write fails with errBiggerThanMaxLen once that raw
+	// input exceeds MaxWriteLength * TransformInputMultiple. Zero means
+	// defaultTransformInputMultiple. Transform's output size isn't known
+	// until Mark or Flush runs it, so this can't be as tight a bound as the
+	// one Write enforces without a Transform, but it still keeps a single
+	// chunk's accumulation from growing without limit.
+	TransformInputMultiple int
+
+	// MaxRetries is how many additional attempts are made to write a chunk
+	// to Writer after RetryClassifier reports its error as retryable. Zero
+	// means no retries. Once an error isn't retried, successfully or not, it
+	// becomes sticky: every later Write, Mark or Flush call fails fast with
+	// it.
+	MaxRetries int
+
+	// Backoff, if set, is called with the zero-based attempt number before
+	// each retry, and its return value is slept before trying again.
+	Backoff func(attempt int) time.Duration
+
+	// RetryClassifier decides whether an error from Writer is worth
+	// retrying, e.g. checking a net.Error's Temporary method. Nil means no
+	// error is retried.
+	RetryClassifier func(err error) bool
+
+	// OnRetry, if set, is called after each retried write with the
+	// one-based attempt number that just failed and the error that
+	// triggered the retry.
+	OnRetry func(attempt int, err error)
+
+	mark int
+	acc  bytes.Buffer
+
+	jobsOnce sync.Once
+	jobs     chan chunkJob
+	bufPool  sync.Pool
+	wg       sync.WaitGroup
+
+	mu        sync.Mutex
+	cond      *sync.Cond
+	seq       uint64
+	nextWrite uint64
+	werr      error
 }
 
 // Buffers data for future writes. Writes do not happen until Mark or Flush is
 // called.
 func (w *Writer) Write(d []byte) (int, error) {
-	var buf *bytes.Buffer
-	if w.two {
-		buf = &w.buf2
-	} else {
-		buf = &w.buf1
+	if err := w.fatalErr(); err != nil {
+		return 0, err
 	}
 
-	n, err := buf.Write(d)
-	if buf.Len()-w.mark > w.MaxWriteLength {
+	n, err := w.acc.Write(d)
+	if w.Transform == nil {
+		if w.acc.Len()-w.mark > w.MaxWriteLength {
+			return 0, errBiggerThanMaxLen
+		}
+	} else if w.acc.Len()-w.mark > w.MaxWriteLength*w.transformInputMultiple() {
 		return 0, errBiggerThanMaxLen
 	}
 	return n, err
 }
 
-// Flushes the pending data if any.
+// transformInputMultiple reports the effective TransformInputMultiple:
+// defaultTransformInputMultiple when it's left at zero, otherwise
+// TransformInputMultiple itself.
+func (w *Writer) transformInputMultiple() int {
+	if w.TransformInputMultiple == 0 {
+		return defaultTransformInputMultiple
+	}
+	return w.TransformInputMultiple
+}
+
+// transform runs Transform on chunk, if set, and checks that the result fits
+// MaxWriteLength. With no Transform, chunk is returned unchanged, since
+// Write already verified its size on the way in.
+func (w *Writer) transform(chunk []byte) ([]byte, error) {
+	if w.Transform == nil {
+		return chunk, nil
+	}
+	out, err := w.Transform(chunk)
+	if err != nil {
+		return nil, err
+	}
+	if len(out) > w.MaxWriteLength {
+		return nil, ErrTransformedTooBig
+	}
+	return out, nil
+}
+
+// Flushes the pending data if any. When PipelineDepth is in use, Flush
+// blocks until every chunk handed to the worker pool so far has been
+// written, and returns the first error any of them encountered.
 func (w *Writer) Flush() error {
-	var pri *bytes.Buffer
-	if w.two {
-		pri = &w.buf2
-	} else {
-		pri = &w.buf1
+	if err := w.fatalErr(); err != nil {
+		return err
 	}
 
-	prilen := pri.Len()
-	if w.mark != prilen {
+	acclen := w.acc.Len()
+	if w.mark != acclen {
 		return errFlushBeforeMark
 	}
 
-	contents := pri.Bytes()
-	n, err := w.Writer.Write(contents[:prilen])
+	chunk, err := w.transform(w.acc.Bytes()[:acclen])
 	if err != nil {
 		return err
 	}
-	if n != w.mark {
-		return errUnexpectedLen
+
+	if w.PipelineDepth > 1 {
+		if err := w.checkErr(); err != nil {
+			return err
+		}
+		w.enqueue(chunk)
+		w.acc.Reset()
+		w.mark = 0
+		return w.drain()
+	}
+
+	if err := w.writeChunk(chunk); err != nil {
+		w.setFatalErr(err)
+		return err
 	}
-	pri.Reset()
+	w.acc.Reset()
 	w.mark = 0
 	return nil
 }
@@ -76,40 +196,178 @@ func (w *Writer) Flush() error {
 // if necessary. If the length of the data from the previous mark to this one
 // is larger than the MaxWriteLength, it is considered an error.
 func (w *Writer) Mark() error {
-	var pri, sec *bytes.Buffer
-	if w.two {
-		pri = &w.buf2
-		sec = &w.buf1
-	} else {
-		pri = &w.buf1
-		sec = &w.buf2
+	if err := w.fatalErr(); err != nil {
+		return err
 	}
 
-	prilen := pri.Len()
-	if prilen > w.MaxWriteLength {
-		// we need to flush upto the previous mark and swith buffers
-		contents := pri.Bytes()
-		n, err := w.Writer.Write(contents[:w.mark])
+	acclen := w.acc.Len()
+	if acclen > w.MaxWriteLength {
+		// we need to flush upto the previous mark, then retire that prefix
+		// from acc so the bytes after it become the new pending data
+		oldMark := w.mark
+		chunk, err := w.transform(w.acc.Bytes()[:oldMark])
 		if err != nil {
 			return err
 		}
-		if n != w.mark {
-			return errUnexpectedLen
-		}
-		n, err = sec.Write(contents[w.mark:])
-		if err != nil {
+		if w.PipelineDepth > 1 {
+			if err := w.checkErr(); err != nil {
+				return err
+			}
+			w.enqueue(chunk)
+		} else if err := w.writeChunk(chunk); err != nil {
+			w.setFatalErr(err)
 			return err
 		}
-		if n != prilen-w.mark {
-			return errUnexpectedLen
-		}
-		w.mark = n
-		pri.Reset()
-		w.two = !w.two
+		w.acc.Next(oldMark)
+		w.mark = acclen - oldMark
 	} else {
 		// we can move the mark and delay writing
-		w.mark = prilen
+		w.mark = acclen
 	}
 
 	return nil
 }
+
+// setup starts the worker pool the first time it's needed.
+func (w *Writer) setup() {
+	w.cond = sync.NewCond(&w.mu)
+	w.jobs = make(chan chunkJob, w.PipelineDepth)
+	for i := 0; i < w.PipelineDepth; i++ {
+		w.wg.Add(1)
+		go w.worker()
+	}
+}
+
+// enqueue copies data into a pooled buffer and hands it to the worker pool,
+// tagged with its position in the stream, and returns without waiting for
+// it to be written.
+func (w *Writer) enqueue(data []byte) {
+	w.jobsOnce.Do(w.setup)
+
+	buf, _ := w.bufPool.Get().([]byte)
+	buf = append(buf[:0], data...)
+
+	w.mu.Lock()
+	seq := w.seq
+	w.seq++
+	w.mu.Unlock()
+
+	w.jobs <- chunkJob{seq: seq, data: buf}
+}
+
+// worker writes chunks handed to it over jobs, waiting for its turn so
+// chunks reach w.Writer in the same order they were enqueued. Only one
+// worker is ever actually writing at a time; PipelineDepth lets the others
+// queue up behind it instead of blocking their caller.
+func (w *Writer) worker() {
+	defer w.wg.Done()
+	for job := range w.jobs {
+		w.mu.Lock()
+		for job.seq != w.nextWrite && w.werr == nil {
+			w.cond.Wait()
+		}
+		err := w.werr
+		w.mu.Unlock()
+
+		if err == nil {
+			err = w.writeChunk(job.data)
+		}
+
+		w.mu.Lock()
+		if err != nil && w.werr == nil {
+			w.werr = err
+		}
+		w.nextWrite = job.seq + 1
+		w.cond.Broadcast()
+		w.mu.Unlock()
+
+		w.bufPool.Put(job.data[:0])
+	}
+}
+
+// checkErr starts the worker pool if needed and reports the first error it
+// has encountered, if any.
+func (w *Writer) checkErr() error {
+	w.jobsOnce.Do(w.setup)
+	return w.fatalErr()
+}
+
+// fatalErr reports the Writer's sticky error, if any, without starting the
+// worker pool.
+func (w *Writer) fatalErr() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.werr
+}
+
+// setFatalErr makes err sticky, if nothing already is, so every later
+// Write, Mark or Flush call fails fast with it.
+func (w *Writer) setFatalErr(err error) {
+	w.mu.Lock()
+	if w.werr == nil {
+		w.werr = err
+	}
+	w.mu.Unlock()
+}
+
+// retryable reports whether err is worth retrying, per RetryClassifier.
+func (w *Writer) retryable(err error) bool {
+	if w.RetryClassifier == nil {
+		return false
+	}
+	return w.RetryClassifier(err)
+}
+
+// writeChunk writes chunk to w.Writer, retrying retryable errors up to
+// MaxRetries times with Backoff between attempts. chunk itself is untouched
+// by a failed attempt, so it can simply be retried as-is.
+func (w *Writer) writeChunk(chunk []byte) error {
+	for attempt := 0; ; attempt++ {
+		n, err := w.Writer.Write(chunk)
+		if err == nil && n != len(chunk) {
+			err = errUnexpectedLen
+		}
+		if err == nil {
+			return nil
+		}
+		if attempt >= w.MaxRetries || !w.retryable(err) {
+			return err
+		}
+		if w.OnRetry != nil {
+			w.OnRetry(attempt+1, err)
+		}
+		if w.Backoff != nil {
+			time.Sleep(w.Backoff(attempt))
+		}
+	}
+}
+
+// drain blocks until every enqueued chunk has been written and returns the
+// first error encountered, if any.
+func (w *Writer) drain() error {
+	w.mu.Lock()
+	for w.nextWrite < w.seq {
+		w.cond.Wait()
+	}
+	err := w.werr
+	w.mu.Unlock()
+	return err
+}
+
+// Close shuts down the worker pool started when PipelineDepth is greater
+// than 1, waiting for all enqueued chunks to finish writing and stopping
+// the workers before returning. It is a no-op, other than reporting the
+// sticky error if any, when PipelineDepth is 1 or less. Close must be
+// called once a Writer with PipelineDepth > 1 is done being used, or its
+// workers leak for the life of the process; it must not be followed by
+// further use of the Writer.
+func (w *Writer) Close() error {
+	if w.PipelineDepth <= 1 {
+		return w.fatalErr()
+	}
+	w.jobsOnce.Do(w.setup)
+	err := w.drain()
+	close(w.jobs)
+	w.wg.Wait()
+	return err
+}
@@ -2,7 +2,11 @@ package chunky_test
 
 import (
 	"bytes"
+	"errors"
+	"runtime"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/daaku/go.chunky"
 )
@@ -117,6 +121,346 @@ func TestBiggerThanMax(t *testing.T) {
 	}
 }
 
+func TestConcurrency(t *testing.T) {
+	chunks := [][]byte{
+		[]byte("hello"),
+		[]byte("world"),
+		[]byte("foo"),
+		[]byte("bar"),
+		[]byte("baz"),
+	}
+
+	var mu sync.Mutex
+	var got [][]byte
+	realw := writer{
+		f: func(b []byte) (int, error) {
+			cp := make([]byte, len(b))
+			copy(cp, b)
+			mu.Lock()
+			got = append(got, cp)
+			mu.Unlock()
+			return len(b), nil
+		},
+	}
+
+	chunkyw := &chunky.Writer{
+		Writer:         realw,
+		MaxWriteLength: len(chunks[0]),
+		PipelineDepth:  4,
+	}
+
+	for _, chunk := range chunks {
+		if _, err := chunkyw.Write(chunk); err != nil {
+			t.Fatal(err)
+		}
+		if err := chunkyw.Mark(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := chunkyw.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := chunkyw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(got) != len(chunks) {
+		t.Fatalf("was expecting %d writes but got %d", len(chunks), len(got))
+	}
+	for i, chunk := range chunks {
+		if !bytes.Equal(got[i], chunk) {
+			t.Fatalf(`was expecting "%s" at position %d but got "%s"`, chunk, i, got[i])
+		}
+	}
+}
+
+func TestConcurrencyStickyError(t *testing.T) {
+	boom := errors.New("boom")
+	realw := writer{
+		f: func(b []byte) (int, error) {
+			return 0, boom
+		},
+	}
+
+	chunkyw := &chunky.Writer{
+		Writer:         realw,
+		MaxWriteLength: 5,
+		PipelineDepth:  2,
+	}
+
+	if _, err := chunkyw.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if err := chunkyw.Mark(); err != nil {
+		t.Fatal(err)
+	}
+	if err := chunkyw.Flush(); err != boom {
+		t.Fatalf("was expecting %v but got %v", boom, err)
+	}
+	if err := chunkyw.Close(); err != boom {
+		t.Fatalf("was expecting %v but got %v", boom, err)
+	}
+}
+
+func TestConcurrencyClose(t *testing.T) {
+	realw := writer{
+		f: func(b []byte) (int, error) {
+			return len(b), nil
+		},
+	}
+
+	chunkyw := &chunky.Writer{
+		Writer:         realw,
+		MaxWriteLength: 5,
+		PipelineDepth:  4,
+	}
+
+	if _, err := chunkyw.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if err := chunkyw.Mark(); err != nil {
+		t.Fatal(err)
+	}
+	if err := chunkyw.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	before := runtime.NumGoroutine()
+	if err := chunkyw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() >= before && time.Now().Before(deadline) {
+		runtime.Gosched()
+	}
+	if n := runtime.NumGoroutine(); n >= before {
+		t.Fatalf("expected worker goroutines to exit, had %d before Close and %d after", before, n)
+	}
+}
+
+func TestTransform(t *testing.T) {
+	data := []byte("hello")
+	var realw bytes.Buffer
+	chunkyw := &chunky.Writer{
+		Writer:         &realw,
+		MaxWriteLength: len(data),
+		Transform: func(in []byte) ([]byte, error) {
+			out := make([]byte, len(in))
+			for i, b := range in {
+				out[i] = b + 1
+			}
+			return out, nil
+		},
+	}
+
+	if _, err := chunkyw.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := chunkyw.Mark(); err != nil {
+		t.Fatal(err)
+	}
+	if err := chunkyw.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []byte("ifmmp")
+	if !bytes.Equal(realw.Bytes(), want) {
+		t.Fatalf(`was expecting "%s" but got "%s"`, want, realw.Bytes())
+	}
+}
+
+func TestTransformTooBig(t *testing.T) {
+	data := []byte("hello")
+	var realw bytes.Buffer
+	chunkyw := &chunky.Writer{
+		Writer:         &realw,
+		MaxWriteLength: len(data),
+		Transform: func(in []byte) ([]byte, error) {
+			return append(in, in...), nil
+		},
+	}
+
+	if _, err := chunkyw.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := chunkyw.Mark(); err != nil {
+		t.Fatal(err)
+	}
+	if err := chunkyw.Flush(); err != chunky.ErrTransformedTooBig {
+		t.Fatalf("was expecting %v but got %v", chunky.ErrTransformedTooBig, err)
+	}
+}
+
+func TestTransformInputBound(t *testing.T) {
+	var realw bytes.Buffer
+	chunkyw := &chunky.Writer{
+		Writer:         &realw,
+		MaxWriteLength: 5,
+		Transform: func(in []byte) ([]byte, error) {
+			return in, nil
+		},
+	}
+
+	// within MaxWriteLength * default multiple (4): ok
+	if _, err := chunkyw.Write(bytes.Repeat([]byte("x"), 20)); err != nil {
+		t.Fatal(err)
+	}
+
+	// past the bound: rejected before Transform ever sees it
+	i, err := chunkyw.Write([]byte("x"))
+	if err == nil {
+		t.Fatal("was expecting an error")
+	}
+	if i != 0 {
+		t.Fatalf("was expecting %d but got %d", 0, i)
+	}
+}
+
+func TestTransformInputBoundCustomMultiple(t *testing.T) {
+	var realw bytes.Buffer
+	chunkyw := &chunky.Writer{
+		Writer:                 &realw,
+		MaxWriteLength:         5,
+		TransformInputMultiple: 1,
+		Transform: func(in []byte) ([]byte, error) {
+			return in, nil
+		},
+	}
+
+	if _, err := chunkyw.Write(bytes.Repeat([]byte("x"), 5)); err != nil {
+		t.Fatal(err)
+	}
+	i, err := chunkyw.Write([]byte("x"))
+	if err == nil {
+		t.Fatal("was expecting an error")
+	}
+	if i != 0 {
+		t.Fatalf("was expecting %d but got %d", 0, i)
+	}
+}
+
+func TestRetrySucceedsAfterTransientErrors(t *testing.T) {
+	errTemporary := errors.New("temporary")
+	var attempts int
+	var retried []int
+	realw := writer{
+		f: func(b []byte) (int, error) {
+			attempts++
+			if attempts < 3 {
+				return 0, errTemporary
+			}
+			return len(b), nil
+		},
+	}
+
+	chunkyw := &chunky.Writer{
+		Writer:          realw,
+		MaxWriteLength:  5,
+		MaxRetries:      2,
+		RetryClassifier: func(err error) bool { return err == errTemporary },
+		OnRetry: func(attempt int, err error) {
+			retried = append(retried, attempt)
+		},
+	}
+
+	if _, err := chunkyw.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if err := chunkyw.Mark(); err != nil {
+		t.Fatal(err)
+	}
+	if err := chunkyw.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if attempts != 3 {
+		t.Fatalf("was expecting 3 attempts but got %d", attempts)
+	}
+	if len(retried) != 2 || retried[0] != 1 || retried[1] != 2 {
+		t.Fatalf("was expecting OnRetry calls for attempts 1 and 2 but got %v", retried)
+	}
+}
+
+func TestRetryBackoffSlept(t *testing.T) {
+	errTemporary := errors.New("temporary")
+	var attempts int
+	realw := writer{
+		f: func(b []byte) (int, error) {
+			attempts++
+			if attempts < 2 {
+				return 0, errTemporary
+			}
+			return len(b), nil
+		},
+	}
+
+	var slept []int
+	chunkyw := &chunky.Writer{
+		Writer:          realw,
+		MaxWriteLength:  5,
+		MaxRetries:      1,
+		RetryClassifier: func(err error) bool { return err == errTemporary },
+		Backoff: func(attempt int) time.Duration {
+			slept = append(slept, attempt)
+			return 0
+		},
+	}
+
+	if _, err := chunkyw.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if err := chunkyw.Mark(); err != nil {
+		t.Fatal(err)
+	}
+	if err := chunkyw.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if len(slept) != 1 || slept[0] != 0 {
+		t.Fatalf("was expecting a single backoff for attempt 0 but got %v", slept)
+	}
+}
+
+func TestNonRetryableErrorIsSticky(t *testing.T) {
+	boom := errors.New("boom")
+	var attempts int
+	realw := writer{
+		f: func(b []byte) (int, error) {
+			attempts++
+			return 0, boom
+		},
+	}
+
+	chunkyw := &chunky.Writer{
+		Writer:         realw,
+		MaxWriteLength: 5,
+	}
+
+	if _, err := chunkyw.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if err := chunkyw.Mark(); err != nil {
+		t.Fatal(err)
+	}
+	if err := chunkyw.Flush(); err != boom {
+		t.Fatalf("was expecting %v but got %v", boom, err)
+	}
+	if attempts != 1 {
+		t.Fatalf("was expecting 1 attempt but got %d", attempts)
+	}
+
+	if _, err := chunkyw.Write([]byte("world")); err != boom {
+		t.Fatalf("was expecting sticky %v but got %v", boom, err)
+	}
+	if err := chunkyw.Mark(); err != boom {
+		t.Fatalf("was expecting sticky %v but got %v", boom, err)
+	}
+	if err := chunkyw.Flush(); err != boom {
+		t.Fatalf("was expecting sticky %v but got %v", boom, err)
+	}
+	if attempts != 1 {
+		t.Fatalf("was expecting no further attempts but got %d", attempts)
+	}
+}
+
 func TestFlushBeforeMark(t *testing.T) {
 	data := []byte("hello")
 	var realw bytes.Buffer
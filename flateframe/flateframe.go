@@ -0,0 +1,79 @@
+// Package flateframe implements a small, self-delimited frame format meant
+// to be plugged in as a chunky.Writer.Transform: each frame carries the
+// length and a CRC32 checksum of its compressed payload, so a reader can
+// tell where one frame ends and verify it wasn't corrupted in transit.
+//
+// It compresses with compress/flate, since this module has no external
+// dependencies, but the framing follows the same
+// length-then-checksum-then-payload shape Snappy's own stream format uses.
+package flateframe
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io/ioutil"
+)
+
+var (
+	// ErrShortFrame is returned by Decode when a frame doesn't contain as
+	// many payload bytes as its header promises.
+	ErrShortFrame = errors.New("flateframe: frame shorter than its header length")
+
+	// ErrChecksumMismatch is returned by Decode when a frame's payload
+	// doesn't match the checksum recorded in its header.
+	ErrChecksumMismatch = errors.New("flateframe: checksum mismatch")
+)
+
+// headerLen is the size in bytes of a frame's header: a uint32 payload
+// length followed by a uint32 CRC32 checksum of that payload.
+const headerLen = 4 + 4
+
+// Encode compresses in and wraps it in a frame recording its length and
+// checksum. It matches the chunky.Writer.Transform signature, so it can be
+// assigned to it directly.
+func Encode(in []byte) ([]byte, error) {
+	var compressed bytes.Buffer
+	fw, err := flate.NewWriter(&compressed, flate.DefaultCompression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := fw.Write(in); err != nil {
+		return nil, err
+	}
+	if err := fw.Close(); err != nil {
+		return nil, err
+	}
+
+	payload := compressed.Bytes()
+	frame := make([]byte, headerLen+len(payload))
+	binary.BigEndian.PutUint32(frame[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(frame[4:8], crc32.ChecksumIEEE(payload))
+	copy(frame[headerLen:], payload)
+	return frame, nil
+}
+
+// Decode verifies and decompresses a single frame previously produced by
+// Encode, returning the original bytes passed to it.
+func Decode(frame []byte) ([]byte, error) {
+	if len(frame) < headerLen {
+		return nil, ErrShortFrame
+	}
+	length := binary.BigEndian.Uint32(frame[0:4])
+	checksum := binary.BigEndian.Uint32(frame[4:8])
+
+	payload := frame[headerLen:]
+	if uint32(len(payload)) < length {
+		return nil, ErrShortFrame
+	}
+	payload = payload[:length]
+	if crc32.ChecksumIEEE(payload) != checksum {
+		return nil, ErrChecksumMismatch
+	}
+
+	fr := flate.NewReader(bytes.NewReader(payload))
+	defer fr.Close()
+	return ioutil.ReadAll(fr)
+}
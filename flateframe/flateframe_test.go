@@ -0,0 +1,40 @@
+package flateframe_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/daaku/go.chunky/flateframe"
+)
+
+func TestEncodeDecode(t *testing.T) {
+	data := []byte("hello hello hello hello world world world")
+	frame, err := flateframe.Encode(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := flateframe.Decode(frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out, data) {
+		t.Fatalf(`was expecting "%s" but got "%s"`, data, out)
+	}
+}
+
+func TestDecodeShortFrame(t *testing.T) {
+	if _, err := flateframe.Decode([]byte("short")); err != flateframe.ErrShortFrame {
+		t.Fatalf("was expecting %v but got %v", flateframe.ErrShortFrame, err)
+	}
+}
+
+func TestDecodeChecksumMismatch(t *testing.T) {
+	frame, err := flateframe.Encode([]byte("hello world"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	frame[len(frame)-1] ^= 0xff
+	if _, err := flateframe.Decode(frame); err != flateframe.ErrChecksumMismatch {
+		t.Fatalf("was expecting %v but got %v", flateframe.ErrChecksumMismatch, err)
+	}
+}
@@ -0,0 +1,212 @@
+package chunky
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+)
+
+var errPacketWriterClosed = errors.New("chunky: PacketWriter used after EndMessage")
+
+// frameHeaderLen is the size in bytes of the framing header PacketWriter
+// prepends to each datagram and PacketReader strips back off: a message ID,
+// a sequence number and the total number of chunks in the message.
+const frameHeaderLen = 4 + 2 + 2
+
+// PacketWriter adapts a net.PacketConn into the io.Writer interface expected
+// by Writer.Writer, sending each accumulated chunk as a single WriteTo call.
+// When Framed is true, the header described by frameHeaderLen is prepended
+// to every datagram so a PacketReader on the other end can reassemble the
+// message even if datagrams arrive out of order.
+//
+// A PacketWriter backs a single chunky.Writer for the duration of one
+// semantic message: the total chunk count isn't known until the message is
+// done, so framed datagrams are held until EndMessage is called, at which
+// point they are all written with Total filled in. Use a fresh PacketWriter
+// for each message.
+type PacketWriter struct {
+	Conn      net.PacketConn
+	Addr      net.Addr
+	Framed    bool
+	MessageID uint32
+
+	chunks [][]byte
+	closed bool
+}
+
+// Write buffers or sends d depending on Framed. It satisfies io.Writer so a
+// PacketWriter can be used as the Writer field of a chunky.Writer.
+func (w *PacketWriter) Write(d []byte) (int, error) {
+	if w.closed {
+		return 0, errPacketWriterClosed
+	}
+	if !w.Framed {
+		return w.Conn.WriteTo(d, w.Addr)
+	}
+	cp := make([]byte, len(d))
+	copy(cp, d)
+	w.chunks = append(w.chunks, cp)
+	return len(d), nil
+}
+
+// EndMessage sends the chunks buffered for the current message now that the
+// total chunk count is known, and closes the PacketWriter against further
+// use. It is a no-op when Framed is false, since chunks were already sent as
+// they were written.
+func (w *PacketWriter) EndMessage() error {
+	w.closed = true
+	if !w.Framed {
+		return nil
+	}
+	total := uint16(len(w.chunks))
+	header := make([]byte, frameHeaderLen)
+	binary.BigEndian.PutUint32(header[0:4], w.MessageID)
+	binary.BigEndian.PutUint16(header[6:8], total)
+	for seq, chunk := range w.chunks {
+		binary.BigEndian.PutUint16(header[4:6], uint16(seq))
+		if _, err := w.Conn.WriteTo(append(header, chunk...), w.Addr); err != nil {
+			return err
+		}
+	}
+	w.chunks = nil
+	return nil
+}
+
+// defaultMaxPendingMessages is the bound PacketReader applies when
+// MaxPendingMessages is left at its zero value. Lossy UDP is the whole
+// reason this package's reassembly buffer is bounded at all: a dropped
+// datagram otherwise pins a partial packetMessage in r.pending forever, so
+// a default of unbounded would silently leak memory for the life of the
+// process on any real network.
+const defaultMaxPendingMessages = 64
+
+// packetMessage holds the chunks seen so far for a message still being
+// reassembled.
+type packetMessage struct {
+	total  uint16
+	chunks map[uint16][]byte
+}
+
+// PacketReader consumes framed datagrams written by a PacketWriter,
+// reassembling them into complete messages and tolerating out-of-order and
+// duplicate datagrams within a bounded reassembly buffer.
+type PacketReader struct {
+	Conn net.PacketConn
+
+	// MaxPendingMessages bounds how many partially reassembled messages are
+	// held in memory at once; the oldest is dropped to make room for a new
+	// one. Zero uses defaultMaxPendingMessages. A negative value disables
+	// the bound, which is strongly discouraged against real, lossy UDP: a
+	// single dropped datagram then pins a partial message in memory for
+	// good.
+	MaxPendingMessages int
+
+	pending map[uint32]*packetMessage
+	order   []uint32
+	ready   [][]byte
+	current []byte
+}
+
+// Next reads datagrams from Conn, reassembling messages as they complete,
+// until a chunk is available to be read with Chunk. It returns false only
+// when Conn returns an error, which Next passes through.
+func (r *PacketReader) Next() (bool, error) {
+	for len(r.ready) == 0 {
+		buf := make([]byte, 65507)
+		n, _, err := r.Conn.ReadFrom(buf)
+		if err != nil {
+			return false, err
+		}
+		if n < frameHeaderLen {
+			continue
+		}
+		datagram := buf[:n]
+		msgID := binary.BigEndian.Uint32(datagram[0:4])
+		seq := binary.BigEndian.Uint16(datagram[4:6])
+		total := binary.BigEndian.Uint16(datagram[6:8])
+		payload := datagram[frameHeaderLen:]
+
+		// A malformed or spoofed datagram claiming a seq outside [0, total)
+		// would let len(msg.chunks) == int(msg.total) become true without
+		// every seq in that range actually present, e.g. seq=5, total=1.
+		// Checking against the message's already-established total, not the
+		// incoming datagram's own, stops a later spoofed datagram from
+		// inflating that bound and poisoning an in-progress reassembly;
+		// keeping every key added below inside [0, total) means reaching
+		// that count is only possible once all of them are.
+		msg := r.pending[msgID]
+		switch {
+		case msg == nil && (total == 0 || seq >= total):
+			continue
+		case msg != nil && seq >= msg.total:
+			continue
+		}
+
+		if msg == nil {
+			if r.pending == nil {
+				r.pending = make(map[uint32]*packetMessage)
+			}
+			r.evict()
+			msg = &packetMessage{total: total, chunks: make(map[uint16][]byte)}
+			r.pending[msgID] = msg
+			r.order = append(r.order, msgID)
+		}
+		if _, dup := msg.chunks[seq]; dup {
+			continue
+		}
+		cp := make([]byte, len(payload))
+		copy(cp, payload)
+		msg.chunks[seq] = cp
+
+		if len(msg.chunks) == int(msg.total) {
+			for i := uint16(0); i < msg.total; i++ {
+				r.ready = append(r.ready, msg.chunks[i])
+			}
+			delete(r.pending, msgID)
+			r.forget(msgID)
+		}
+	}
+	r.current, r.ready = r.ready[0], r.ready[1:]
+	return true, nil
+}
+
+// Chunk returns the payload most recently made available by Next.
+func (r *PacketReader) Chunk() []byte {
+	return r.current
+}
+
+// maxPending reports the effective bound on pending messages: defaultMaxPendingMessages
+// when MaxPendingMessages is zero, disabled when it's negative, and
+// MaxPendingMessages itself otherwise.
+func (r *PacketReader) maxPending() int {
+	switch {
+	case r.MaxPendingMessages == 0:
+		return defaultMaxPendingMessages
+	case r.MaxPendingMessages < 0:
+		return 0
+	default:
+		return r.MaxPendingMessages
+	}
+}
+
+// evict drops the oldest pending message if the effective MaxPendingMessages
+// bound would otherwise be exceeded.
+func (r *PacketReader) evict() {
+	max := r.maxPending()
+	if max <= 0 || len(r.order) < max {
+		return
+	}
+	oldest := r.order[0]
+	r.order = r.order[1:]
+	delete(r.pending, oldest)
+}
+
+// forget removes id from the pending order list.
+func (r *PacketReader) forget(id uint32) {
+	for i, v := range r.order {
+		if v == id {
+			r.order = append(r.order[:i], r.order[i+1:]...)
+			return
+		}
+	}
+}
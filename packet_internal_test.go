@@ -0,0 +1,85 @@
+package chunky
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+type evictTestAddr string
+
+func (a evictTestAddr) Network() string { return "fake" }
+func (a evictTestAddr) String() string  { return string(a) }
+
+// evictTestConn is a net.PacketConn that replays a queued list of datagrams,
+// then returns errDone, so PacketReader.Next stops deterministically even
+// though none of the queued messages ever completes.
+type evictTestConn struct {
+	datagrams [][]byte
+}
+
+var errDone = errors.New("chunky: evictTestConn exhausted")
+
+func (c *evictTestConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	if len(c.datagrams) == 0 {
+		return 0, nil, errDone
+	}
+	d := c.datagrams[0]
+	c.datagrams = c.datagrams[1:]
+	return copy(b, d), evictTestAddr("peer"), nil
+}
+
+func (c *evictTestConn) WriteTo(b []byte, addr net.Addr) (int, error) { return len(b), nil }
+func (c *evictTestConn) Close() error                                 { return nil }
+func (c *evictTestConn) LocalAddr() net.Addr                          { return evictTestAddr("local") }
+func (c *evictTestConn) SetDeadline(t time.Time) error                { return nil }
+func (c *evictTestConn) SetReadDeadline(t time.Time) error            { return nil }
+func (c *evictTestConn) SetWriteDeadline(t time.Time) error           { return nil }
+
+func evictTestDatagram(msgID uint32, seq, total uint16) []byte {
+	d := make([]byte, frameHeaderLen)
+	binary.BigEndian.PutUint32(d[0:4], msgID)
+	binary.BigEndian.PutUint16(d[4:6], seq)
+	binary.BigEndian.PutUint16(d[6:8], total)
+	return d
+}
+
+func TestPacketReaderDefaultBoundEvicts(t *testing.T) {
+	conn := &evictTestConn{}
+	for id := uint32(1); id <= defaultMaxPendingMessages+1; id++ {
+		conn.datagrams = append(conn.datagrams, evictTestDatagram(id, 0, 2))
+	}
+
+	r := &PacketReader{Conn: conn}
+	if _, err := r.Next(); err != errDone {
+		t.Fatalf("was expecting %v but got %v", errDone, err)
+	}
+
+	if len(r.pending) != defaultMaxPendingMessages {
+		t.Fatalf("was expecting %d pending messages but got %d", defaultMaxPendingMessages, len(r.pending))
+	}
+	if _, ok := r.pending[1]; ok {
+		t.Fatal("was expecting the oldest message to have been evicted")
+	}
+	if _, ok := r.pending[defaultMaxPendingMessages+1]; !ok {
+		t.Fatal("was expecting the newest message to still be pending")
+	}
+}
+
+func TestPacketReaderNegativeMaxPendingIsUnbounded(t *testing.T) {
+	conn := &evictTestConn{}
+	for id := uint32(1); id <= defaultMaxPendingMessages+1; id++ {
+		conn.datagrams = append(conn.datagrams, evictTestDatagram(id, 0, 2))
+	}
+
+	r := &PacketReader{Conn: conn, MaxPendingMessages: -1}
+	if _, err := r.Next(); err != errDone {
+		t.Fatalf("was expecting %v but got %v", errDone, err)
+	}
+
+	if len(r.pending) != defaultMaxPendingMessages+1 {
+		t.Fatalf("was expecting %d pending messages but got %d", defaultMaxPendingMessages+1, len(r.pending))
+	}
+}
@@ -0,0 +1,153 @@
+package chunky_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/daaku/go.chunky"
+)
+
+type fakeAddr string
+
+func (a fakeAddr) Network() string { return "fake" }
+func (a fakeAddr) String() string  { return string(a) }
+
+// fakePacketConn is an in-memory net.PacketConn backed by a channel, enough
+// to exercise PacketWriter/PacketReader without touching the network.
+type fakePacketConn struct {
+	datagrams chan []byte
+}
+
+func newFakePacketConn() *fakePacketConn {
+	return &fakePacketConn{datagrams: make(chan []byte, 16)}
+}
+
+func (c *fakePacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	d := <-c.datagrams
+	return copy(b, d), fakeAddr("peer"), nil
+}
+
+func (c *fakePacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	cp := make([]byte, len(b))
+	copy(cp, b)
+	c.datagrams <- cp
+	return len(b), nil
+}
+
+func (c *fakePacketConn) Close() error                       { return nil }
+func (c *fakePacketConn) LocalAddr() net.Addr                { return fakeAddr("local") }
+func (c *fakePacketConn) SetDeadline(t time.Time) error      { return nil }
+func (c *fakePacketConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *fakePacketConn) SetWriteDeadline(t time.Time) error { return nil }
+
+func TestPacketWriterUnframed(t *testing.T) {
+	conn := newFakePacketConn()
+	pw := &chunky.PacketWriter{Conn: conn, Addr: fakeAddr("dst")}
+	chunkyw := &chunky.Writer{Writer: pw, MaxWriteLength: 5}
+
+	if _, err := chunkyw.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if err := chunkyw.Mark(); err != nil {
+		t.Fatal(err)
+	}
+	if err := chunkyw.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	got := <-conn.datagrams
+	if !bytes.Equal(got, []byte("hello")) {
+		t.Fatalf(`was expecting "hello" but got "%s"`, got)
+	}
+}
+
+func TestPacketWriterReaderFramed(t *testing.T) {
+	conn := newFakePacketConn()
+	pw := &chunky.PacketWriter{Conn: conn, Addr: fakeAddr("dst"), Framed: true, MessageID: 1}
+	chunkyw := &chunky.Writer{Writer: pw, MaxWriteLength: 5}
+
+	chunks := [][]byte{[]byte("hello"), []byte("world"), []byte("foo")}
+	for _, chunk := range chunks {
+		if _, err := chunkyw.Write(chunk); err != nil {
+			t.Fatal(err)
+		}
+		if err := chunkyw.Mark(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := chunkyw.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := pw.EndMessage(); err != nil {
+		t.Fatal(err)
+	}
+
+	pr := &chunky.PacketReader{Conn: conn}
+	for _, want := range chunks {
+		ok, err := pr.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ok {
+			t.Fatal("was expecting a chunk")
+		}
+		if !bytes.Equal(pr.Chunk(), want) {
+			t.Fatalf(`was expecting "%s" but got "%s"`, want, pr.Chunk())
+		}
+	}
+}
+
+// rawDatagram builds a framed datagram by hand, so tests can send
+// out-of-range sequence numbers a real PacketWriter would never produce.
+func rawDatagram(msgID uint32, seq, total uint16, payload []byte) []byte {
+	d := make([]byte, 8+len(payload))
+	binary.BigEndian.PutUint32(d[0:4], msgID)
+	binary.BigEndian.PutUint16(d[4:6], seq)
+	binary.BigEndian.PutUint16(d[6:8], total)
+	copy(d[8:], payload)
+	return d
+}
+
+func TestPacketReaderRejectsOutOfRangeSeq(t *testing.T) {
+	conn := newFakePacketConn()
+	conn.datagrams <- rawDatagram(1, 5, 1, []byte("spoofed"))
+	conn.datagrams <- rawDatagram(1, 0, 1, []byte("real"))
+
+	pr := &chunky.PacketReader{Conn: conn}
+	ok, err := pr.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok {
+		t.Fatal("was expecting a chunk")
+	}
+	if !bytes.Equal(pr.Chunk(), []byte("real")) {
+		t.Fatalf(`was expecting "real" but got "%s"`, pr.Chunk())
+	}
+}
+
+func TestPacketReaderRejectsSeqBeyondEstablishedTotal(t *testing.T) {
+	conn := newFakePacketConn()
+	conn.datagrams <- rawDatagram(1, 0, 3, []byte("a"))
+	conn.datagrams <- rawDatagram(1, 5, 100, []byte("spoofed"))
+	conn.datagrams <- rawDatagram(1, 1, 3, []byte("b"))
+	conn.datagrams <- rawDatagram(1, 2, 3, []byte("c"))
+
+	pr := &chunky.PacketReader{Conn: conn}
+	want := [][]byte{[]byte("a"), []byte("b"), []byte("c")}
+	for _, w := range want {
+		ok, err := pr.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ok {
+			t.Fatal("was expecting a chunk")
+		}
+		if !bytes.Equal(pr.Chunk(), w) {
+			t.Fatalf(`was expecting "%s" but got "%s"`, w, pr.Chunk())
+		}
+	}
+}
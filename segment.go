@@ -0,0 +1,152 @@
+package chunky
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// DefaultSegmentSize is the segment size SegmentWriter pre-allocates when
+// SegmentSize is left at zero.
+const DefaultSegmentSize = 512 << 20 // 512MB
+
+// SegmentInfo describes one segment written by a SegmentWriter.
+type SegmentInfo struct {
+	ID   int
+	Path string
+	Size int64
+}
+
+// SegmentWriter is an io.Writer that rotates through a directory of
+// pre-allocated, fixed-size segment files, never splitting a single Write
+// call across two of them. It is meant to back a chunky.Writer, which
+// already never issues a Write call that straddles a mark; SegmentWriter
+// extends that same invariant across file boundaries.
+type SegmentWriter struct {
+	Dir string
+
+	// SegmentSize is the size each segment is pre-allocated to. Zero means
+	// DefaultSegmentSize.
+	SegmentSize int64
+
+	cur     *os.File
+	curID   int
+	curUsed int64
+
+	segments []SegmentInfo
+}
+
+func (w *SegmentWriter) segmentSize() int64 {
+	if w.SegmentSize > 0 {
+		return w.SegmentSize
+	}
+	return DefaultSegmentSize
+}
+
+// Write writes d to the current segment, rotating to a new pre-allocated
+// segment first if d would otherwise have to be split across two of them.
+func (w *SegmentWriter) Write(d []byte) (int, error) {
+	if int64(len(d)) > w.segmentSize() {
+		return 0, fmt.Errorf("chunky: chunk of %d bytes is bigger than segment size %d", len(d), w.segmentSize())
+	}
+	if w.cur == nil || w.curUsed+int64(len(d)) > w.segmentSize() {
+		if err := w.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := w.cur.Write(d)
+	w.curUsed += int64(n)
+	w.segments[len(w.segments)-1].Size = w.curUsed
+	return n, err
+}
+
+// rotate truncates and closes the current segment, if any, to its actual
+// used length, and pre-allocates a new one to take its place.
+func (w *SegmentWriter) rotate() error {
+	if err := w.closeCurrent(); err != nil {
+		return err
+	}
+
+	id := w.curID
+	path := filepath.Join(w.Dir, fmt.Sprintf("%08d.chunky", id))
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := f.Truncate(w.segmentSize()); err != nil {
+		f.Close()
+		return err
+	}
+
+	w.cur = f
+	w.curUsed = 0
+	w.curID = id + 1
+	w.segments = append(w.segments, SegmentInfo{ID: id, Path: path})
+	return nil
+}
+
+func (w *SegmentWriter) closeCurrent() error {
+	if w.cur == nil {
+		return nil
+	}
+	if err := w.cur.Truncate(w.curUsed); err != nil {
+		return err
+	}
+	err := w.cur.Close()
+	w.cur = nil
+	return err
+}
+
+// Close truncates and closes the current segment, if any. SegmentWriter is
+// unusable after Close.
+func (w *SegmentWriter) Close() error {
+	return w.closeCurrent()
+}
+
+// Segments returns the segments written so far, in the order they were
+// opened.
+func (w *SegmentWriter) Segments() []SegmentInfo {
+	out := make([]SegmentInfo, len(w.segments))
+	copy(out, w.segments)
+	return out
+}
+
+// OpenSegment opens segment id for reading, sized to the bytes actually
+// written to it rather than its pre-allocated capacity.
+func (w *SegmentWriter) OpenSegment(id int) (io.ReadCloser, error) {
+	for _, s := range w.segments {
+		if s.ID == id {
+			f, err := os.Open(s.Path)
+			if err != nil {
+				return nil, err
+			}
+			return &segmentReader{f: f, remaining: s.Size}, nil
+		}
+	}
+	return nil, fmt.Errorf("chunky: no segment with id %d", id)
+}
+
+// segmentReader limits reads to a segment's used length, since the
+// underlying file may still be pre-allocated past that point.
+type segmentReader struct {
+	f         *os.File
+	remaining int64
+}
+
+func (r *segmentReader) Read(p []byte) (int, error) {
+	if r.remaining <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > r.remaining {
+		p = p[:r.remaining]
+	}
+	n, err := r.f.Read(p)
+	r.remaining -= int64(n)
+	return n, err
+}
+
+func (r *segmentReader) Close() error {
+	return r.f.Close()
+}
@@ -0,0 +1,74 @@
+package chunky_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/daaku/go.chunky"
+)
+
+func TestSegmentWriterRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chunky-segment-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	sw := &chunky.SegmentWriter{Dir: dir, SegmentSize: 10}
+	chunkyw := &chunky.Writer{Writer: sw, MaxWriteLength: 10}
+
+	chunks := [][]byte{
+		[]byte("hello"),
+		[]byte("world"),
+		[]byte("foobarbaz!"),
+	}
+	for _, chunk := range chunks {
+		if _, err := chunkyw.Write(chunk); err != nil {
+			t.Fatal(err)
+		}
+		if err := chunkyw.Mark(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := chunkyw.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := sw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	segments := sw.Segments()
+	if len(segments) != 2 {
+		t.Fatalf("was expecting 2 segments but got %d", len(segments))
+	}
+
+	rc, err := sw.OpenSegment(segments[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	got, err := ioutil.ReadAll(rc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []byte("helloworld")
+	if !bytes.Equal(got, want) {
+		t.Fatalf(`was expecting "%s" but got "%s"`, want, got)
+	}
+
+	rc2, err := sw.OpenSegment(segments[1].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc2.Close()
+	got2, err := ioutil.ReadAll(rc2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want2 := []byte("foobarbaz!")
+	if !bytes.Equal(got2, want2) {
+		t.Fatalf(`was expecting "%s" but got "%s"`, want2, got2)
+	}
+}
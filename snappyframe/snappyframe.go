@@ -0,0 +1,159 @@
+// Package snappyframe implements a small, self-delimited frame format meant
+// to be plugged in as a chunky.Writer.Transform: each frame carries the
+// length and a CRC32 checksum of its Snappy-encoded payload, so a reader can
+// tell where one frame ends and verify it wasn't corrupted in transit.
+//
+// Unlike flateframe, the payload really is Snappy: Encode emits the literal
+// element of the Snappy block format (https://github.com/google/snappy,
+// format description in snappy's format_description.txt), just without ever
+// emitting a copy (back-reference) element. That keeps this dependency-free
+// while still being real Snappy on the wire — any standard Snappy decoder
+// can decode what Encode produces. The tradeoff is Decode, which only
+// understands the literal element it emits: it cannot decode arbitrary
+// third-party Snappy data that uses copy elements, since that would mean
+// implementing the LZ77-style matching Encode deliberately skips.
+package snappyframe
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+)
+
+var (
+	// ErrShortFrame is returned by Decode when a frame doesn't contain as
+	// many payload bytes as its header promises.
+	ErrShortFrame = errors.New("snappyframe: frame shorter than its header length")
+
+	// ErrChecksumMismatch is returned by Decode when a frame's payload
+	// doesn't match the checksum recorded in its header.
+	ErrChecksumMismatch = errors.New("snappyframe: checksum mismatch")
+
+	// ErrUnsupportedElement is returned by Decode when the Snappy payload
+	// contains a copy element. Encode never produces one, so this only
+	// happens when decoding Snappy data from elsewhere.
+	ErrUnsupportedElement = errors.New("snappyframe: payload uses a Snappy element Decode doesn't support")
+
+	// ErrCorruptVarint is returned by Decode when the Snappy payload's
+	// uncompressed-length varint is malformed.
+	ErrCorruptVarint = errors.New("snappyframe: corrupt uncompressed-length varint")
+)
+
+// headerLen is the size in bytes of a frame's header: a uint32 payload
+// length followed by a uint32 CRC32 checksum of that payload.
+const headerLen = 4 + 4
+
+// tagLiteral is the low two bits of a Snappy element tag byte that mark it
+// as a literal (raw bytes) rather than a copy (back-reference).
+const tagLiteral = 0x00
+
+// Encode wraps in as the literal element of a Snappy block, then wraps that
+// in a frame recording its length and checksum. It matches the
+// chunky.Writer.Transform signature, so it can be assigned to it directly.
+func Encode(in []byte) ([]byte, error) {
+	payload := appendBlock(nil, in)
+
+	frame := make([]byte, headerLen+len(payload))
+	binary.BigEndian.PutUint32(frame[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(frame[4:8], crc32.ChecksumIEEE(payload))
+	copy(frame[headerLen:], payload)
+	return frame, nil
+}
+
+// appendBlock appends the Snappy block encoding of in — its uncompressed
+// length as a varint, followed by in as a single literal element — to dst.
+func appendBlock(dst, in []byte) []byte {
+	dst = binary.AppendUvarint(dst, uint64(len(in)))
+	if len(in) == 0 {
+		return dst
+	}
+	dst = appendLiteralHeader(dst, len(in))
+	return append(dst, in...)
+}
+
+// appendLiteralHeader appends a Snappy literal element's tag byte, and any
+// extra length bytes it needs, for a literal of the given length.
+func appendLiteralHeader(dst []byte, length int) []byte {
+	n := uint64(length - 1)
+	switch {
+	case length <= 60:
+		return append(dst, byte(n<<2)|tagLiteral)
+	case length < 1<<8:
+		return append(dst, 60<<2|tagLiteral, byte(n))
+	case length < 1<<16:
+		return append(dst, 61<<2|tagLiteral, byte(n), byte(n>>8))
+	case length < 1<<24:
+		return append(dst, 62<<2|tagLiteral, byte(n), byte(n>>8), byte(n>>16))
+	default:
+		return append(dst, 63<<2|tagLiteral, byte(n), byte(n>>8), byte(n>>16), byte(n>>24))
+	}
+}
+
+// Decode verifies a single frame previously produced by Encode and returns
+// the original bytes passed to it.
+func Decode(frame []byte) ([]byte, error) {
+	if len(frame) < headerLen {
+		return nil, ErrShortFrame
+	}
+	length := binary.BigEndian.Uint32(frame[0:4])
+	checksum := binary.BigEndian.Uint32(frame[4:8])
+
+	payload := frame[headerLen:]
+	if uint32(len(payload)) < length {
+		return nil, ErrShortFrame
+	}
+	payload = payload[:length]
+	if crc32.ChecksumIEEE(payload) != checksum {
+		return nil, ErrChecksumMismatch
+	}
+
+	return decodeBlock(payload)
+}
+
+// decodeBlock reads the uncompressed length and single literal element a
+// Snappy block produced by appendBlock holds, and returns its payload.
+func decodeBlock(block []byte) ([]byte, error) {
+	uncompressedLen, n := binary.Uvarint(block)
+	if n <= 0 {
+		return nil, ErrCorruptVarint
+	}
+	block = block[n:]
+
+	if len(block) == 0 {
+		if uncompressedLen != 0 {
+			return nil, ErrShortFrame
+		}
+		return nil, nil
+	}
+
+	tag := block[0]
+	if tag&0x03 != tagLiteral {
+		return nil, ErrUnsupportedElement
+	}
+
+	x := uint64(tag) >> 2
+	var literalLen uint64
+	switch {
+	case x < 60:
+		literalLen = x + 1
+		block = block[1:]
+	default:
+		extra := int(x - 59)
+		if len(block) < 1+extra {
+			return nil, ErrShortFrame
+		}
+		var n uint64
+		for i := 0; i < extra; i++ {
+			n |= uint64(block[1+i]) << (8 * i)
+		}
+		literalLen = n + 1
+		block = block[1+extra:]
+	}
+
+	if uint64(len(block)) < literalLen || literalLen != uncompressedLen {
+		return nil, ErrShortFrame
+	}
+	out := make([]byte, literalLen)
+	copy(out, block[:literalLen])
+	return out, nil
+}
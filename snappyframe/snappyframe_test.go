@@ -0,0 +1,69 @@
+package snappyframe_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/daaku/go.chunky/snappyframe"
+)
+
+func TestEncodeDecode(t *testing.T) {
+	data := []byte("hello hello hello hello world world world")
+	frame, err := snappyframe.Encode(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := snappyframe.Decode(frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out, data) {
+		t.Fatalf(`was expecting "%s" but got "%s"`, data, out)
+	}
+}
+
+func TestEncodeDecodeEmpty(t *testing.T) {
+	frame, err := snappyframe.Encode(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := snappyframe.Decode(frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(out) != 0 {
+		t.Fatalf("was expecting no bytes but got %q", out)
+	}
+}
+
+func TestEncodeDecodeLongLiteral(t *testing.T) {
+	data := bytes.Repeat([]byte("x"), 1<<17) // forces a multi-byte literal length
+	frame, err := snappyframe.Encode(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := snappyframe.Decode(frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out, data) {
+		t.Fatalf("was expecting %d bytes back but got %d", len(data), len(out))
+	}
+}
+
+func TestDecodeShortFrame(t *testing.T) {
+	if _, err := snappyframe.Decode([]byte("short")); err != snappyframe.ErrShortFrame {
+		t.Fatalf("was expecting %v but got %v", snappyframe.ErrShortFrame, err)
+	}
+}
+
+func TestDecodeChecksumMismatch(t *testing.T) {
+	frame, err := snappyframe.Encode([]byte("hello world"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	frame[len(frame)-1] ^= 0xff
+	if _, err := snappyframe.Decode(frame); err != snappyframe.ErrChecksumMismatch {
+		t.Fatalf("was expecting %v but got %v", snappyframe.ErrChecksumMismatch, err)
+	}
+}